@@ -1,166 +1,332 @@
 import json
-import pickle
+import pickletools
 import sys
-import zipfile
 import argparse
-import io
-from types import ModuleType
-import jsonpickle
-from jsonpickle.unpickler import Unpickler as JsonPickleUnpickler
-
-class RevertableList(list):
-    def __setstate__(self, state):
-        if isinstance(state, list):
-            self.extend(state)
-        elif isinstance(state, dict):
-            self.__dict__.update(state)
-        else:
-            self.state = state
+import zipfile
+import savefile
 
-class RevertableDict(dict):
-    def __setstate__(self, state):
-        if isinstance(state, dict):
-            self.update(state)
-        else:
-            self.state = state
-
-class RevertableSet(set):
-    def __setstate__(self, state):
-        if isinstance(state, set):
-            self.update(state)
-        elif isinstance(state, dict):
-            self.__dict__.update(state)
-        else:
-            self.state = state
-
-class GenericPlaceholder:
-    def __init__(self, *args, **kwargs):
-        pass
-    def __setstate__(self, state):
-        if isinstance(state, dict):
-            self.__dict__.update(state)
-        else:
-            self.state = state
-
-_placeholder_cache = {}
-
-def get_placeholder_class(module_name, class_name):
-    key = (module_name, class_name)
-    if key in _placeholder_cache:
-        return _placeholder_cache[key]
-
-    base_classes = {
-        "RevertableList": RevertableList,
-        "RevertableDict": RevertableDict,
-        "RevertableSet": RevertableSet,
-    }
-    base_class = base_classes.get(class_name, GenericPlaceholder)
-    new_class = type(class_name, (base_class,), {})
-    new_class.__module__ = module_name
-
-    # Create nested modules if they don't exist
-    parts = module_name.split('.')
-    for i in range(1, len(parts) + 1):
-        sub_module_name = '.'.join(parts[:i])
-        if sub_module_name not in sys.modules:
-            new_mod = ModuleType(sub_module_name)
-            sys.modules[sub_module_name] = new_mod
-            if i > 1:
-                parent_module_name = '.'.join(parts[:i-1])
-                parent_module = sys.modules[parent_module_name]
-                setattr(parent_module, parts[i-1], new_mod)
-
-    final_module = sys.modules[module_name]
-    setattr(final_module, class_name, new_class)
-
-    _placeholder_cache[key] = new_class
-    return new_class
-
-class CustomUnpickler(pickle.Unpickler):
-    def find_class(self, module, name):
-        return get_placeholder_class(module, name)
-
-class CustomJsonUnpickler(JsonPickleUnpickler):
-    def find_class(self, module, name):
-        try:
-            __import__(module)
-            return super().find_class(module, name)
-        except (ImportError, AttributeError, ModuleNotFoundError):
-            return get_placeholder_class(module, name)
+def import_yaml():
+    # PyYAML is only needed for --format yaml, so it isn't a hard dependency.
+    try:
+        import yaml
+    except ImportError:
+        raise ValueError("YAML support needs PyYAML (pip install pyyaml)")
+    return yaml
+
+def dump_envelope(output_data, fmt):
+    if fmt == 'yaml':
+        # The same jsonpickle-tagged structure, just written as YAML.
+        yaml = import_yaml()
+        return yaml.safe_dump(output_data, sort_keys=False, allow_unicode=True).rstrip('\n')
+    return json.dumps(output_data, indent=2)
+
+def load_envelope(path, fmt):
+    if fmt is None:
+        fmt = 'yaml' if path.endswith(('.yaml', '.yml')) else 'json'
+    with open(path, 'r', encoding='utf-8') as f:
+        if fmt == 'yaml':
+            return import_yaml().safe_load(f)
+        return json.load(f)
+
+def write_text(text):
+    # Always UTF-8, the encoding load_envelope reads, so that YAML's
+    # unescaped text survives a console set to e.g. cp1252.
+    sys.stdout.flush()
+    sys.stdout.buffer.write(text.encode('utf-8') + b'\n')
+    sys.stdout.flush()
+
+def open_save(args):
+    return savefile.load_save(args.save_file, args.entry, 'raw' if args.raw else None)
 
 def decode(args):
+    save = open_save(args)
+    if save.is_persistent:
+        print("Note: this is a Ren'Py persistent file, shared by every save slot.", file=sys.stderr)
+    write_text(dump_envelope(savefile.to_json(save, args.root), args.format))
+
+def audit_entries(args, save):
+    if not args.audit:
+        return None
+    if save.container != 'zip':
+        raise ValueError("--audit needs a zip save to add its entry to")
+    original = savefile.load_save(args.save_file, save.entry_name, save.container)
+    return savefile.audit_entry(args.save_file, original.data, save.data)
+
+def write_output(args, save, output_file):
+    backup_file = savefile.write_save(save, args.save_file, output_file, audit_entries(args, save))
+    print(f"Successfully created new save file: {output_file}")
+    if backup_file is not None:
+        print(f"The original save was kept as {backup_file}")
+    if args.verify:
+        report_verify(save, output_file)
+
+def report_verify(save, output_file):
+    differences = savefile.verify_save(save, output_file)
+    for difference in differences:
+        print(f"Warning: {difference}", file=sys.stderr)
+    if differences:
+        print(f"Warning: {output_file} does not decode to the intended data, don't replace your save with it", file=sys.stderr)
+        sys.exit(1)
+    print("Verified: the new save decodes to the intended data.")
+
+def check_types(template_data, data):
+    # Type changes at paths the template already has, as (problems, warnings).
+    # Filling in a None or turning an int into a float is an ordinary edit,
+    # so those are only warnings.
+    problems, warnings = [], []
+    for path, old_type, new_type in savefile.type_changes(template_data, data):
+        message = f"{path or '<root>'}: changed type from {old_type} in the template to {new_type}"
+        if old_type == 'NoneType' or (old_type, new_type) == ('int', 'float'):
+            warnings.append(message)
+        else:
+            problems.append(message)
+    return problems, warnings
+
+def encode(args):
+    input_data = load_envelope(args.json_file, args.format)
+
+    save = savefile.from_json(input_data)
+    if input_data.get('__root__'):
+        savefile.merge_root(save, args.save_file, input_data['__root__'])
+
+    if args.dry_run:
+        problems = savefile.validate(save)
+        original = savefile.load_save(args.save_file, save.entry_name, save.container)
+        type_problems, warnings = check_types(original.data, save.data)
+        problems += type_problems
+        for warning in warnings:
+            print(f"Warning: {warning}", file=sys.stderr)
+        for problem in problems:
+            print(f"Problem: {problem}", file=sys.stderr)
+        if problems:
+            sys.exit(1)
+        print("The edited data re-encodes and loads cleanly.")
+        return
+
+    if args.output_file is None:
+        raise ValueError("output_file is required unless --dry-run is given")
+    write_output(args, save, args.output_file)
+
+def schema(args):
+    save = open_save(args)
+    print(json.dumps(savefile.describe_schema(save.data), indent=2))
+
+def entries(args):
+    savefile.read_file(args.save_file)
+    if not zipfile.is_zipfile(args.save_file):
+        raise ValueError(f"{args.save_file} is not a zip archive")
+
+    # Still list the entries when no log can be found, since that's usually
+    # when people want to see what's in the archive.
+    try:
+        log_entry = savefile.load_save(args.save_file).entry_name
+    except ValueError as e:
+        log_entry = None
+        print(f"Warning: {e}", file=sys.stderr)
+
     with zipfile.ZipFile(args.save_file, 'r') as z:
-        metadata = {}
-        if 'json' in z.namelist():
-            with z.open('json') as f:
-                metadata = json.load(f)
+        infos = z.infolist()
+    width = max([len(item.filename) for item in infos] + [4])
+    print(f"  {'Name':<{width}}  {'Size':>10}  {'Compressed':>10}")
+    for item in infos:
+        marker = '*' if item.filename == log_entry else ' '
+        print(f"{marker} {item.filename:<{width}}  {item.file_size:>10}  {item.compress_size:>10}")
+    if log_entry is not None:
+        print("* the pickled save log that decode and edit work on")
 
-        log_content = z.read('log')
+def inspect(args):
+    # The opcode listing (offset, opcode, argument) of the save log, for
+    # debugging saves that don't decode.
+    entry_name, log_content = savefile.read_log(args.save_file, args.entry, 'raw' if args.raw else None)
+    print(f"Disassembling '{entry_name}' ({len(log_content)} bytes).", file=sys.stderr)
+    pickletools.dis(log_content)
 
-        pickle_version = None
-        if log_content.startswith(b'\x80'):
-            pickle_version = log_content[1]
+def stats(args):
+    save = open_save(args)
+    print(json.dumps(savefile.collect_stats(save), indent=2))
 
-        log_buffer = io.BytesIO(log_content)
-        unpickler = CustomUnpickler(log_buffer)
-        data = unpickler.load()
+def parse_value(text):
+    # 0x-prefixed values are integers, handy for bitmask flags.
+    if text.lstrip('-').lower().startswith('0x'):
+        try:
+            return int(text, 16)
+        except ValueError:
+            raise ValueError(f"not a valid hex number: {text}")
+    try:
+        return json.loads(text)
+    except ValueError:
+        return text
 
-        json_friendly_data = json.loads(jsonpickle.encode(data, unpicklable=True))
+def plural(count, word):
+    return f"{count} {word}{'s' if count != 1 else ''}"
 
-        output_data = {
-            'metadata': metadata,
-            'data': json_friendly_data
-        }
-        if pickle_version is not None:
-            output_data['__pickle_version__'] = pickle_version
+def replace(args):
+    save = open_save(args)
+    changed, skipped = savefile.replace_strings(save.data, args.old, args.new, args.ignore_case, args.whole_value)
 
-        print(json.dumps(output_data, indent=2))
+    for path, count in changed:
+        print(f"{path}: {plural(count, 'replacement')}")
+    for path, reason in skipped:
+        print(f"{path}: matched but not changed: {reason}", file=sys.stderr)
+    print(f"{plural(sum(count for _, count in changed), 'replacement')} in {plural(len(changed), 'field')}.")
 
-def encode(args):
-    with open(args.json_file, 'r') as f:
-        input_data = json.load(f)
+    # Without --out this is only a preview.
+    if args.out is not None:
+        if changed:
+            write_output(args, save, args.out)
+        else:
+            print(f"Nothing to change, so {args.out} was not written.", file=sys.stderr)
+
+def is_number(value):
+    return isinstance(value, (int, float)) and not isinstance(value, bool)
+
+def apply_delta(current, op, delta, path):
+    if not is_number(current):
+        raise ValueError(f"{path} holds {savefile.a_type(current)}, relative edits only work on numbers")
+    if not is_number(delta):
+        raise ValueError(f"the amount for {path}{op}= must be a number")
+    return current + delta if op == '+' else current - delta
 
-    metadata = input_data.get('metadata', {})
-    data_as_dict = input_data.get('data', {})
-    data_as_json_str = json.dumps(data_as_dict)
+def coerce_like(data, path, value):
+    # JSON only has arrays and objects, so a list replacing a tuple, (frozen)set
+    # or list subclass (e.g. a RevertableList), or a dict replacing a dict
+    # subclass, is rebuilt as that type rather than silently becoming plain.
+    try:
+        current = savefile.get_path(data, path)
+    except ValueError:
+        return value
+    if type(value) is dict:
+        rebuild = isinstance(current, dict) and type(current) is not dict
+    elif type(value) is list:
+        rebuild = isinstance(current, (list, tuple, set, frozenset)) and type(current) is not list
+    else:
+        rebuild = False
+    if rebuild:
+        try:
+            return type(current)(value)
+        except TypeError as e:
+            raise ValueError(f"{path} holds {savefile.a_type(current)}, which can't hold these items: {e}")
+    return value
 
-    custom_unpickler = CustomJsonUnpickler()
-    data = jsonpickle.decode(data_as_json_str, context=custom_unpickler)
+def edit(args):
+    save = open_save(args)
 
-    pickle_version = input_data.get('__pickle_version__', 2)
+    if args.get is not None:
+        value = savefile.get_path(save.data, args.get)
+        if args.hex:
+            if not isinstance(value, int) or isinstance(value, bool):
+                raise ValueError(f"{args.get} holds {savefile.a_type(value)}, --hex only works on integers")
+            print(hex(value))
+            return
+        print(json.dumps(savefile.encode_value(value), indent=2))
+        return
 
-    pickled_log_buffer = io.BytesIO()
-    pickle.dump(data, pickled_log_buffer, protocol=pickle_version)
-    pickled_log_buffer.seek(0)
+    if not args.set and not args.rename:
+        raise ValueError("nothing to do, pass --set, --rename or --get")
+    if args.out is None:
+        raise ValueError("--out is required when using --set or --rename")
 
-    with zipfile.ZipFile(args.output_file, 'w', zipfile.ZIP_DEFLATED) as new_zip:
-        with zipfile.ZipFile(args.save_file, 'r') as original_zip:
-            for item in original_zip.infolist():
-                if item.filename not in ['log', 'json']:
-                    new_zip.writestr(item, original_zip.read(item.filename))
+    for rename in args.rename or []:
+        path, sep, new_key = rename.partition('=')
+        if not sep:
+            raise ValueError(f"expected PATH=NEWKEY, got: {rename}")
+        savefile.rename_key(save.data, path, new_key)
 
-        new_zip.writestr('log', pickled_log_buffer.read())
-        new_zip.writestr('json', json.dumps(metadata))
+    for assignment in args.set or []:
+        path, sep, text = assignment.partition('=')
+        if not sep:
+            raise ValueError(f"expected PATH=VALUE, got: {assignment}")
+        value = parse_value(text)
+        if path.endswith(('+', '-')):
+            # PATH+=N / PATH-=N adjust a number relative to its current value.
+            path, op = path[:-1], path[-1]
+            value = apply_delta(savefile.get_path(save.data, path), op, value, path)
+        savefile.set_path(save.data, path, coerce_like(save.data, path, value))
 
-    print(f"Successfully created new save file: {args.output_file}")
+    write_output(args, save, args.out)
 
 def main():
     parser = argparse.ArgumentParser(description="A Ren'Py save editor.")
     subparsers = parser.add_subparsers(dest="command", required=True)
     decode_parser = subparsers.add_parser("decode", help="Decode a Ren'Py save file to lossless JSON.")
     decode_parser.add_argument("save_file", help="The path to the Ren'Py save file.")
+    decode_parser.add_argument("--entry", help="The zip entry holding the pickle to decode (default: 'log', or the first pickled entry).")
+    decode_parser.add_argument("--raw", action="store_true", help="Read the file as a bare pickle, skipping zip and compression detection.")
+    decode_parser.add_argument("--root", metavar="PATH", help="Only export the subtree at PATH. encode merges it back into the template save.")
+    decode_parser.add_argument("--format", choices=["json", "yaml"], default="json", help="The output format (default: json).")
     encode_parser = subparsers.add_parser("encode", help="Encode a JSON file back into a Ren'Py save file.")
-    encode_parser.add_argument("json_file", help="The path to the input JSON file.")
+    encode_parser.add_argument("json_file", help="The path to the input JSON (or YAML) file.")
+    encode_parser.add_argument("--format", choices=["json", "yaml"], help="The input format (default: from the file extension, else json).")
     encode_parser.add_argument("save_file", help="The path to the original Ren'Py save file (to use as a template).")
-    encode_parser.add_argument("output_file", help="The path for the new output save file.")
+    encode_parser.add_argument("output_file", nargs="?", help="The path for the new output save file.")
+    encode_parser.add_argument("--dry-run", action="store_true", help="Rebuild and re-load the save to check it, and flag values whose type differs from the template, without writing anything.")
+    encode_parser.add_argument("--verify", action="store_true", help="Load the written save back and check it holds the intended data.")
+    encode_parser.add_argument("--audit", action="store_true", help=f"Record the changed paths and a timestamp in a {savefile.AUDIT_ENTRY} entry of the new save.")
+    edit_parser = subparsers.add_parser("edit", help="Read or change individual values in a Ren'Py save file.")
+    edit_parser.add_argument("save_file", help="The path to the Ren'Py save file.")
+    edit_parser.add_argument("--entry", help="The zip entry holding the pickle to edit (default: 'log', or the first pickled entry).")
+    edit_parser.add_argument("--raw", action="store_true", help="Read the file as a bare pickle, skipping zip and compression detection.")
+    edit_parser.add_argument("--get", metavar="PATH", help="Print the value at PATH, e.g. '0/store.money'. Dict keys that aren't strings are written as e.g. '#int:5' or '#none', as schema lists them.")
+    edit_parser.add_argument("--hex", action="store_true", help="With --get, print an integer in hex.")
+    edit_parser.add_argument("--set", metavar="PATH=VALUE", action="append", help="Assign a JSON value (or plain string) to PATH, or adjust a number with PATH+=N / PATH-=N. Numbers may be written in hex as 0x1F. May be repeated.")
+    edit_parser.add_argument("--rename", metavar="PATH=NEWKEY", action="append", help="Rename the dict key (or attribute) at PATH, keeping its value. A key that isn't a string takes a JSON value of the same type, e.g. 6, or an array of its parts for a tuple. Applied before --set. May be repeated.")
+    edit_parser.add_argument("--out", help="The path for the new output save file.")
+    edit_parser.add_argument("--verify", action="store_true", help="Load the written save back and check it holds the intended data.")
+    edit_parser.add_argument("--audit", action="store_true", help=f"Record the changed paths and a timestamp in a {savefile.AUDIT_ENTRY} entry of the new save.")
+    replace_parser = subparsers.add_parser("replace", help="Find and replace text across every string value in a Ren'Py save file.")
+    replace_parser.add_argument("save_file", help="The path to the Ren'Py save file.")
+    replace_parser.add_argument("old", help="The text to search for.")
+    replace_parser.add_argument("new", help="The replacement text.")
+    replace_parser.add_argument("--entry", help="The zip entry holding the pickle to edit (default: 'log', or the first pickled entry).")
+    replace_parser.add_argument("--raw", action="store_true", help="Read the file as a bare pickle, skipping zip and compression detection.")
+    replace_parser.add_argument("--ignore-case", action="store_true", help="Match without regard to case.")
+    replace_parser.add_argument("--whole-value", action="store_true", help="Only replace strings that equal the search text entirely.")
+    replace_parser.add_argument("--out", help="The path for the new output save file. Without it, only the affected paths are listed.")
+    replace_parser.add_argument("--verify", action="store_true", help="Load the written save back and check it holds the intended data.")
+    replace_parser.add_argument("--audit", action="store_true", help=f"Record the changed paths and a timestamp in a {savefile.AUDIT_ENTRY} entry of the new save.")
+    schema_parser = subparsers.add_parser("schema", help="Print the paths and types in a Ren'Py save file, without values.")
+    schema_parser.add_argument("save_file", help="The path to the Ren'Py save file.")
+    schema_parser.add_argument("--entry", help="The zip entry holding the pickle to describe (default: 'log', or the first pickled entry).")
+    schema_parser.add_argument("--raw", action="store_true", help="Read the file as a bare pickle, skipping zip and compression detection.")
+    stats_parser = subparsers.add_parser("stats", help="Print size, depth and type counts for a Ren'Py save file.")
+    stats_parser.add_argument("save_file", help="The path to the Ren'Py save file.")
+    stats_parser.add_argument("--entry", help="The zip entry holding the pickle to describe (default: 'log', or the first pickled entry).")
+    stats_parser.add_argument("--raw", action="store_true", help="Read the file as a bare pickle, skipping zip and compression detection.")
+    inspect_parser = subparsers.add_parser("inspect", help="Print the pickle opcodes of a Ren'Py save file's log, for debugging corrupt saves.")
+    inspect_parser.add_argument("save_file", help="The path to the Ren'Py save file.")
+    inspect_parser.add_argument("--entry", help="The zip entry holding the pickle to disassemble (default: 'log', or the first pickled entry).")
+    inspect_parser.add_argument("--raw", action="store_true", help="Read the file as a bare pickle, skipping zip and compression detection.")
+    entries_parser = subparsers.add_parser("entries", help="List the entries inside a Ren'Py save archive.")
+    entries_parser.add_argument("save_file", help="The path to the Ren'Py save file.")
     args = parser.parse_args()
 
-    if args.command == "decode":
-        decode(args)
-    elif args.command == "encode":
-        encode(args)
-    else:
-        parser.print_help()
+    try:
+        if args.command == "decode":
+            decode(args)
+        elif args.command == "encode":
+            encode(args)
+        elif args.command == "edit":
+            edit(args)
+        elif args.command == "replace":
+            replace(args)
+        elif args.command == "schema":
+            schema(args)
+        elif args.command == "stats":
+            stats(args)
+        elif args.command == "inspect":
+            inspect(args)
+        elif args.command == "entries":
+            entries(args)
+        else:
+            parser.print_help()
+    except ValueError as e:
+        print(f"Error: {e}", file=sys.stderr)
+        sys.exit(1)
+    except OSError as e:
+        # The JSON input, template or output path, e.g. a missing file or a directory.
+        target = f"{e.filename}: " if e.filename else ""
+        print(f"Error: {target}{e.strerror}", file=sys.stderr)
+        sys.exit(1)
 
 if __name__ == "__main__":
     main()
@@ -0,0 +1,1111 @@
+import json
+import re
+import pickle
+import pickletools
+import struct
+import sys
+import zipfile
+import gzip
+import zlib
+import io
+import os
+import tempfile
+import shutil
+import collections
+import copyreg
+import codecs
+from datetime import datetime, timezone
+import jsonpickle
+import jsonpickle.handlers
+from jsonpickle.unpickler import Unpickler as JsonPickleUnpickler
+
+class RevertableList(list):
+    def __setstate__(self, state):
+        if isinstance(state, list):
+            self.extend(state)
+        elif isinstance(state, dict):
+            self.__dict__.update(state)
+        else:
+            self.state = state
+
+    def __getstate__(self):
+        # Python 2 emitted BUILD with the (usually empty) __dict__ for list
+        # and dict subclasses; Python 3 skips it when the dict is empty.
+        return self.__dict__
+
+class RevertableDict(dict):
+    def __setstate__(self, state):
+        # The items arrive through SETITEMS, BUILD only carries __dict__.
+        if isinstance(state, dict):
+            self.__dict__.update(state)
+        else:
+            self.state = state
+
+    def __getstate__(self):
+        return self.__dict__
+
+class RevertableSet(set):
+    # Ren'Py pickles these through object.__reduce_ex__ (NEWOBJ + BUILD) with a
+    # ({member: True, ...},) state tuple instead of set's own REDUCE, and its
+    # __setstate__ only understands that shape, so mirror both directions.
+    def __setstate__(self, state):
+        if isinstance(state, tuple):
+            self.update(state[0].keys())
+        else:
+            self.update(state)
+
+    def __getstate__(self):
+        return ({i: True for i in self},)
+
+    __reduce__ = object.__reduce__
+    __reduce_ex__ = object.__reduce_ex__
+
+class Latin1Str(str):
+    # A Python 2 byte string that has to stay one: any that isn't plain ASCII
+    # (e.g. accented text), and any passed to a constructor (e.g. a datetime
+    # payload). The text holds the original bytes via latin-1, and the type
+    # marks it to be pickled back as a byte string.
+    pass
+
+def _codecs_encode(text, encoding):
+    # Python 3 pickles byte strings at protocol 2 as _codecs.encode(text, 'latin1').
+    if encoding == 'latin1':
+        return Latin1Str(text)
+    return codecs.encode(text, encoding)
+
+class Latin1StrHandler(jsonpickle.handlers.BaseHandler):
+    # Spelled out in the JSON so the byte string survives an edit as one.
+    def flatten(self, obj, data):
+        data['latin1'] = str(obj)
+        return data
+
+    def restore(self, data):
+        return Latin1Str(data['latin1'])
+
+jsonpickle.handlers.register(Latin1Str, Latin1StrHandler)
+
+class GenericPlaceholder:
+    # Constructor arguments are kept in __dict__ under these keys, and left
+    # out of the BUILD state, so the object can be pickled back the same way.
+    NEWOBJ_ARGS = '__newargs__'
+    REDUCE_ARGS = '__reduce_args__'
+    # Items added by APPENDS/SETITEMS (e.g. a list or defaultdict subclass)
+    # are kept the same way and handed back as the reduce list/dict items.
+    LIST_ITEMS = '__listitems__'
+    DICT_ITEMS = '__dictitems__'
+    EXTRA_KEYS = (NEWOBJ_ARGS, REDUCE_ARGS, LIST_ITEMS, DICT_ITEMS)
+
+    def __new__(cls, *args, **kwargs):
+        self = super().__new__(cls)
+        if args:
+            self.__dict__[GenericPlaceholder.NEWOBJ_ARGS] = args
+        return self
+    def __init__(self, *args, **kwargs):
+        # Only REDUCE calls the class itself (NEWOBJ just calls __new__),
+        # and the callable may not be a class at all, e.g. NumPy's
+        # _reconstruct, so it has to be re-emitted as REDUCE.
+        self.__dict__.pop(GenericPlaceholder.NEWOBJ_ARGS, None)
+        self.__dict__[GenericPlaceholder.REDUCE_ARGS] = args
+    def append(self, item):
+        self.__dict__.setdefault(GenericPlaceholder.LIST_ITEMS, []).append(item)
+    def extend(self, items):
+        self.__dict__.setdefault(GenericPlaceholder.LIST_ITEMS, []).extend(items)
+    def __setitem__(self, key, value):
+        self.__dict__.setdefault(GenericPlaceholder.DICT_ITEMS, {})[key] = value
+    def __setstate__(self, state):
+        if isinstance(state, dict):
+            self.__dict__.update(state)
+        else:
+            # Classes with a custom __getstate__ (or __slots__, which pickle
+            # as a (dict, slots) tuple) don't hand us a plain __dict__. Keep
+            # the payload whole so BUILD passes it back to __setstate__ as-is.
+            self.state = state
+    def __getstate__(self):
+        state = {key: value for key, value in self.__dict__.items()
+                 if key not in GenericPlaceholder.EXTRA_KEYS}
+        if set(state) == {'state'} and not isinstance(state['state'], dict):
+            return state['state']
+        # Python 2 always emitted BUILD, even for an empty __dict__.
+        return state
+    def __reduce_ex__(self, protocol):
+        state = self.__getstate__()
+        list_items = self.__dict__.get(GenericPlaceholder.LIST_ITEMS)
+        dict_items = self.__dict__.get(GenericPlaceholder.DICT_ITEMS)
+        items = (iter(list_items) if list_items else None,
+                 iter(dict_items.items()) if dict_items else None)
+        if GenericPlaceholder.REDUCE_ARGS in self.__dict__:
+            return (type(self), self.__dict__[GenericPlaceholder.REDUCE_ARGS], state or None) + items
+        args = self.__dict__.get(GenericPlaceholder.NEWOBJ_ARGS, ())
+        return (copyreg.__newobj__, (type(self),) + args, state) + items
+
+_placeholder_cache = {}
+
+# Builtin types that pickle their contents as REDUCE arguments. A placeholder
+# would silently drop those arguments, so these resolve to the real types.
+known_classes = {
+    ("__builtin__", "set"): set,
+    ("__builtin__", "frozenset"): frozenset,
+    ("__builtin__", "complex"): complex,
+    ("builtins", "set"): set,
+    ("builtins", "frozenset"): frozenset,
+    ("builtins", "complex"): complex,
+    ("collections", "OrderedDict"): collections.OrderedDict,
+    ("_codecs", "encode"): _codecs_encode,
+}
+
+def get_placeholder_class(module_name, class_name):
+    key = (module_name, class_name)
+    if key in _placeholder_cache:
+        return _placeholder_cache[key]
+
+    base_classes = {
+        "RevertableList": RevertableList,
+        "RevertableDict": RevertableDict,
+        "RevertableSet": RevertableSet,
+    }
+    base_class = base_classes.get(class_name, GenericPlaceholder)
+    new_class = type(class_name, (base_class,), {})
+    # Placeholders live only in _placeholder_cache, never in sys.modules or
+    # on a real module, where they would replace e.g. os.replace for the
+    # whole process. CustomPickler writes them out by name instead.
+    new_class.__module__ = module_name
+
+    _placeholder_cache[key] = new_class
+    return new_class
+
+# The pure-Python unpickler is used because it's the only one that lets us
+# see Python 2 byte strings (STRING/BINSTRING/SHORT_BINSTRING) as they load.
+class CustomUnpickler(pickle._Unpickler):
+    dispatch = pickle._Unpickler.dispatch.copy()
+
+    def __init__(self, file):
+        super().__init__(file)
+        # ASCII byte strings load as plain str so they read and edit like
+        # text, but are remembered so the ones passed to a constructor, or
+        # in a tuple handed to __setstate__, can stay byte strings; e.g.
+        # datetime.time and a NumPy array's raw data only accept bytes.
+        self.byte_strings = {}
+
+    def find_class(self, module, name):
+        if (module, name) in known_classes:
+            return known_classes[(module, name)]
+        return get_placeholder_class(module, name)
+
+    def _decode_string(self, value):
+        try:
+            text = value.decode('ascii')
+        except UnicodeDecodeError:
+            return Latin1Str(value.decode('latin-1'))
+        self.byte_strings[id(text)] = text
+        return text
+
+    def _is_byte_string(self, value):
+        # Compared by identity, since an id can be reused once a str is freed.
+        return id(value) in self.byte_strings and self.byte_strings[id(value)] is value
+
+    def _mark_byte_string_args(self):
+        args = self.stack[-1]
+        if any(self._is_byte_string(arg) for arg in args):
+            self.stack[-1] = tuple(Latin1Str(arg) if self._is_byte_string(arg) else arg
+                                   for arg in args)
+
+    def load_reduce(self):
+        self._mark_byte_string_args()
+        pickle._Unpickler.load_reduce(self)
+    dispatch[pickle.REDUCE[0]] = load_reduce
+
+    def load_newobj(self):
+        self._mark_byte_string_args()
+        pickle._Unpickler.load_newobj(self)
+    dispatch[pickle.NEWOBJ[0]] = load_newobj
+
+    def load_build(self):
+        if isinstance(self.stack[-1], tuple):
+            self._mark_byte_string_args()
+        pickle._Unpickler.load_build(self)
+    dispatch[pickle.BUILD[0]] = load_build
+
+def is_placeholder_class(obj):
+    return _placeholder_cache.get((getattr(obj, '__module__', None), getattr(obj, '__name__', None))) is obj
+
+# The pure-Python pickler is used because the C one only writes a class it
+# can find again by importing its module, which placeholders can't be.
+class CustomPickler(pickle._Pickler):
+    def save_global(self, obj, name=None):
+        if not is_placeholder_class(obj):
+            return super().save_global(obj, name)
+        module_name, name = obj.__module__, obj.__name__
+        if self.proto >= 4:
+            self.save(module_name)
+            self.save(name)
+            self.write(pickle.STACK_GLOBAL)
+        else:
+            encoding = 'utf-8' if self.proto >= 3 else 'ascii'
+            self.write(pickle.GLOBAL + f"{module_name}\n{name}\n".encode(encoding))
+        self.memoize(obj)
+
+    def reducer_override(self, obj):
+        if type(obj) is Latin1Str:
+            return (codecs.encode, (str(obj), 'latin1'))
+        return NotImplemented
+
+class CustomJsonUnpickler(JsonPickleUnpickler):
+    def find_class(self, module, name):
+        try:
+            __import__(module)
+            return super().find_class(module, name)
+        except (ImportError, AttributeError, ModuleNotFoundError):
+            return get_placeholder_class(module, name)
+
+def _ran_out(message):
+    # How pickletools.genops says the stream ended inside an opcode or
+    # before STOP, as opposed to hitting one it doesn't know.
+    return any(text in message for text in
+               ('not enough data', 'pickle exhausted before seeing STOP', 'but only'))
+
+def describe_pickle_error(content, error):
+    # Walk the opcodes on their own so we can say where the stream stopped
+    # making sense, and whether it simply ran out (a partially written save).
+    position = 0
+    try:
+        for opcode, arg, position in pickletools.genops(content):
+            pass
+    except ValueError as e:
+        if isinstance(error, (EOFError, struct.error)) or _ran_out(str(e)):
+            return f"save appears truncated at byte {len(content)} (last complete opcode at byte {position})"
+        return f"save is corrupt near byte {position}: {e}"
+    return f"could not unpickle save: {error}"
+
+def load_pickle(content):
+    try:
+        return CustomUnpickler(io.BytesIO(content)).load()
+    except Exception as e:
+        raise ValueError(describe_pickle_error(content, e))
+
+def check_duplicate_entries(z):
+    # zipfile quietly resolves a repeated name to its last copy while the
+    # game's loader may pick another, so don't guess which one is real.
+    counts = collections.Counter(item.filename for item in z.infolist())
+    duplicates = [f"'{name}' ({count}x)" for name, count in counts.items() if count > 1]
+    if duplicates:
+        raise ValueError(f"the archive has duplicate entries: {', '.join(duplicates)}")
+
+def find_log_entry(z, entry_name=None):
+    if entry_name is not None:
+        if entry_name not in z.namelist():
+            raise ValueError(f"the save has no entry named '{entry_name}'")
+        log_content = z.read(entry_name)
+        try:
+            return entry_name, log_content, load_pickle(log_content)
+        except ValueError as e:
+            raise ValueError(f"entry '{entry_name}' is not a readable pickle: {e}")
+
+    if 'log' in z.namelist():
+        log_content = z.read('log')
+        return 'log', log_content, load_pickle(log_content)
+
+    # Newer Ren'Py versions and some mods don't name the rollback log 'log',
+    # and combined archives may hold several slots, so collect every entry
+    # that unpickles into a container and use the first.
+    candidates = []
+    for item in z.infolist():
+        if item.filename == 'json' or item.is_dir():
+            continue
+        content = z.read(item.filename)
+        try:
+            data = load_pickle(content)
+        except ValueError:
+            continue
+        if isinstance(data, (dict, list, tuple)):
+            candidates.append((item.filename, content, data))
+
+    if not candidates:
+        return None, None, None
+
+    names = ', '.join(f"'{name}'" for name, _, _ in candidates)
+    if len(candidates) > 1:
+        print(f"No 'log' entry found and several entries hold pickles ({names}); "
+              f"using '{candidates[0][0]}'. Pass --entry to pick another.", file=sys.stderr)
+    else:
+        print(f"No 'log' entry found, using '{candidates[0][0]}' instead.", file=sys.stderr)
+    return candidates[0]
+
+class Save:
+    def __init__(self, data, metadata=None, pickle_version=2, entry_name='log', container='zip', log_size=None):
+        self.data = data
+        self.metadata = metadata if metadata is not None else {}
+        self.pickle_version = pickle_version
+        self.entry_name = entry_name
+        self.container = container
+        self.log_size = log_size
+
+    @property
+    def is_persistent(self):
+        # The persistent file holds one Persistent object shared by every
+        # slot, rather than the (roots, RollbackLog) tuple of a slot save.
+        return type_name(self.data) == 'renpy.persistent.Persistent'
+
+def detect_container(content):
+    if content.startswith(b'PK'):
+        return 'zip'
+    if content.startswith(b'\x1f\x8b'):
+        return 'gzip'
+    # Ren'Py writes the persistent file as a bare zlib stream; a zlib header
+    # is 0x78 followed by a byte that makes the pair a multiple of 31.
+    if len(content) >= 2 and content[0] == 0x78 and int.from_bytes(content[:2], 'big') % 31 == 0:
+        return 'zlib'
+    return 'raw'
+
+def decompress(content, container):
+    if container == 'gzip':
+        return gzip.decompress(content)
+    if container == 'zlib':
+        return zlib.decompress(content)
+    return content
+
+def compress(content, container):
+    if container == 'gzip':
+        return gzip.compress(content)
+    if container == 'zlib':
+        return zlib.compress(content)
+    return content
+
+def read_file(save_file):
+    # A missing file and an empty one are different mistakes, so say which.
+    try:
+        with open(save_file, 'rb') as f:
+            content = f.read()
+    except FileNotFoundError:
+        raise ValueError(f"no such file: {save_file}")
+    except OSError as e:
+        raise ValueError(f"could not read {save_file}: {e.strerror}")
+    if not content:
+        raise ValueError(f"{save_file} is empty (0 bytes), it may not have finished copying or saving")
+    return content
+
+def load_save(save_file, entry_name=None, container=None):
+    # container forces how the file is read (e.g. 'raw' for a bare pickle)
+    # instead of sniffing it.
+    content = read_file(save_file)
+    container = container or detect_container(content)
+    metadata = {}
+    if container == 'zip':
+        with zipfile.ZipFile(io.BytesIO(content), 'r') as z:
+            check_duplicate_entries(z)
+            if 'json' in z.namelist():
+                with z.open('json') as f:
+                    metadata = json.load(f)
+
+            entry_name, log_content, data = find_log_entry(z, entry_name)
+            if entry_name is None:
+                raise ValueError(f"no entry in {save_file} contains a pickled save log")
+    else:
+        entry_name = 'log'
+        try:
+            log_content = decompress(content, container)
+        except (OSError, zlib.error) as e:
+            raise ValueError(f"{save_file} looks like {container} data but does not decompress: {e}")
+        try:
+            data = load_pickle(log_content)
+        except ValueError as e:
+            raise ValueError(f"{save_file} is not a zip save and could not be read as a {container} pickle: {e}")
+
+    pickle_version = None
+    if log_content.startswith(b'\x80'):
+        pickle_version = log_content[1]
+
+    return Save(data, metadata, pickle_version, entry_name, container, len(log_content))
+
+def read_log(save_file, entry_name=None, container=None):
+    # (entry name, pickle bytes) of the save log, found the same way as
+    # load_save but without loading it, so a corrupt log can be inspected.
+    content = read_file(save_file)
+    container = container or detect_container(content)
+    if container != 'zip':
+        try:
+            return 'log', decompress(content, container)
+        except (OSError, zlib.error) as e:
+            raise ValueError(f"{save_file} looks like {container} data but does not decompress: {e}")
+    with zipfile.ZipFile(io.BytesIO(content), 'r') as z:
+        if entry_name is None and 'log' in z.namelist():
+            entry_name = 'log'
+        if entry_name is None:
+            entry_name = find_log_entry(z)[0]
+            if entry_name is None:
+                raise ValueError(f"no entry in {save_file} contains a pickled save log, pass --entry to pick one")
+        if entry_name not in z.namelist():
+            raise ValueError(f"the save has no entry named '{entry_name}'")
+        return entry_name, z.read(entry_name)
+
+def dump_log(save):
+    buffer = io.BytesIO()
+    CustomPickler(buffer, protocol=save.pickle_version or 2).dump(save.data)
+    return buffer.getvalue()
+
+def backup_path(template_file, output_file):
+    # Where the template's old bytes go when the output overwrites it, or
+    # None when the output is a different file.
+    try:
+        if os.path.samefile(template_file, output_file):
+            return output_file + '.bak'
+    except FileNotFoundError:
+        pass
+    return None
+
+def _replace_file(output_file, write, backup_file=None):
+    # Have write(f) fill a temp file next to the target, then swap it in, so
+    # the output can be the template itself and a failed write never leaves
+    # half a save behind.
+    directory = os.path.dirname(os.path.abspath(output_file))
+    fd, temp_file = tempfile.mkstemp(dir=directory, prefix='.reeditor-', suffix='.tmp')
+    try:
+        with os.fdopen(fd, 'wb') as f:
+            write(f)
+        # mkstemp makes the file private; give it the permissions a plain
+        # open() would (or the ones the file being replaced had).
+        try:
+            mode = os.stat(output_file).st_mode & 0o777
+        except FileNotFoundError:
+            umask = os.umask(0)
+            os.umask(umask)
+            mode = 0o666 & ~umask
+        os.chmod(temp_file, mode)
+        if backup_file is not None:
+            shutil.copy2(output_file, backup_file)
+        os.replace(temp_file, output_file)
+    except BaseException:
+        os.unlink(temp_file)
+        raise
+
+def write_save(save, template_file, output_file, extra_entries=None):
+    # Returns the backup made when the output overwrites the template, so
+    # the original save is never lost, or None.
+    backup_file = backup_path(template_file, output_file)
+
+    # Bare pickle, gzip and persistent (zlib) files have no other entries to carry over.
+    if save.container != 'zip':
+        if extra_entries:
+            raise ValueError(f"{', '.join(extra_entries)} can only be added to a zip save")
+        content = compress(dump_log(save), save.container)
+        _replace_file(output_file, lambda f: f.write(content), backup_file)
+        return backup_file
+
+    replacements = {
+        save.entry_name: dump_log(save),
+        'json': json.dumps(save.metadata).encode('utf-8'),
+    }
+    replacements.update(extra_entries or {})
+
+    # Rewrite entries in their original slot with their original ZipInfo, so
+    # order, compression method and timestamps match the template. The
+    # archive goes straight into the temp file and untouched entries are
+    # copied a chunk at a time, so neither zip is held in memory in full.
+    def write(f):
+        with zipfile.ZipFile(f, 'w', zipfile.ZIP_DEFLATED) as new_zip:
+            with zipfile.ZipFile(template_file, 'r') as original_zip:
+                for item in original_zip.infolist():
+                    if item.filename in replacements:
+                        new_zip.writestr(item, replacements.pop(item.filename))
+                    else:
+                        with original_zip.open(item) as source, new_zip.open(item, 'w') as target:
+                            shutil.copyfileobj(source, target)
+
+            for name, content in replacements.items():
+                new_zip.writestr(name, content)
+
+    _replace_file(output_file, write, backup_file)
+    return backup_file
+
+# Ren'Py only reads the entries it knows, so this rides along in the zip
+# without affecting the game.
+AUDIT_ENTRY = 'reeditor-audit.json'
+
+def audit_entry(template_file, before, after):
+    # The template's previous trail, if any, plus one record for this edit.
+    history = []
+    with zipfile.ZipFile(template_file, 'r') as z:
+        if AUDIT_ENTRY in z.namelist():
+            history = json.loads(z.read(AUDIT_ENTRY))
+    history.append({
+        'edited_at': datetime.now(timezone.utc).isoformat(timespec='seconds'),
+        'changes': {path or '<root>': kind for path, kind in diff_data(before, after)},
+    })
+    return {AUDIT_ENTRY: json.dumps(history, indent=2).encode('utf-8')}
+
+class KeyPart(str):
+    # A path part naming a dict key that isn't a string, spelled by
+    # format_key(), e.g. '#int:5' or '#none', so it can't be confused with
+    # the string keys '5' or 'None'.
+    pass
+
+def format_key(key):
+    if key is None:
+        return '#none'
+    if isinstance(key, bool):
+        return f"#bool:{'true' if key else 'false'}"
+    if isinstance(key, int):
+        return f"#int:{key}"
+    if isinstance(key, float):
+        return f"#float:{key!r}"
+    if isinstance(key, tuple):
+        try:
+            return f"#tuple:{json.dumps(key, ensure_ascii=False)}"
+        except TypeError:
+            pass
+    return f"#repr:{key!r}"
+
+def _to_tuple(value):
+    # JSON arrays inside a key are tuples, the only hashable sequence.
+    return tuple(_to_tuple(item) for item in value) if isinstance(value, list) else value
+
+def parse_key(part):
+    # The key a KeyPart names, for adding it to a dict. Keys only spelled by
+    # their repr can be looked up but not created.
+    kind, sep, text = part[1:].partition(':')
+    try:
+        if part == '#none':
+            return None
+        if kind == 'bool' and text in ('true', 'false'):
+            return text == 'true'
+        if kind == 'int':
+            return int(text)
+        if kind == 'float':
+            return float(text)
+        if kind == 'tuple':
+            value = json.loads(text)
+            if isinstance(value, list):
+                key = _to_tuple(value)
+                hash(key)
+                return key
+    except (ValueError, TypeError):
+        pass
+    raise ValueError(f"not a key this tool can create: {part}")
+
+def split_path(path):
+    # Paths are '/'-separated like JSON Pointer, since Ren'Py store keys
+    # already contain dots (e.g. '0/store.money'). '~1' escapes a literal '/'
+    # and '~2' a literal '#', since a part starting with '#' is a KeyPart.
+    if not path:
+        return []
+    parts = []
+    for part in path.split('/'):
+        text = part.replace('~1', '/').replace('~2', '#').replace('~0', '~')
+        parts.append(KeyPart(text) if part.startswith('#') else text)
+    return parts
+
+def _child_key(node, part, path):
+    if isinstance(node, dict):
+        if isinstance(part, KeyPart):
+            for key in node:
+                if not isinstance(key, str) and format_key(key) == part:
+                    return key
+        elif part in node:
+            return part
+        elif part.lstrip('-').isdigit() and int(part) in node:
+            # A bare number still finds an int key when there's no such string key.
+            return int(part)
+    elif isinstance(node, (list, tuple)):
+        if part.lstrip('-').isdigit() and -len(node) <= int(part) < len(node):
+            return int(part)
+    elif part in getattr(node, '__dict__', {}):
+        return part
+    raise ValueError(f"no such path: {path}")
+
+def _get_child(node, key):
+    if isinstance(node, (dict, list, tuple)):
+        return node[key]
+    return node.__dict__[key]
+
+def get_path(data, path):
+    node = data
+    for part in split_path(path):
+        node = _get_child(node, _child_key(node, part, path))
+    return node
+
+def set_path(data, path, value):
+    parts = split_path(path)
+    if not parts:
+        raise ValueError("cannot replace the root of the save")
+
+    parent_path = '/'.join(path.split('/')[:-1])
+    parent = get_path(data, parent_path)
+    if isinstance(parent, dict):
+        # Assigning to a missing dict key adds it.
+        try:
+            key = _child_key(parent, parts[-1], path)
+        except ValueError:
+            key = parse_key(parts[-1]) if isinstance(parts[-1], KeyPart) else parts[-1]
+    else:
+        key = _child_key(parent, parts[-1], path)
+    if isinstance(parent, tuple):
+        # Tuples are immutable, so build a new one and put that in its place,
+        # everywhere the save refers to it, so shared references stay shared.
+        if not parent_path:
+            raise ValueError(f"cannot assign into a tuple at the root of the save: {path}")
+        items = list(parent)
+        items[key] = value
+        rebuilt = type(parent)(items)
+        for other_path in [p for p, v, first_path in walk(data) if v is parent] or [parent_path]:
+            set_path(data, other_path, rebuilt)
+        return
+    if isinstance(parent, (dict, list)):
+        parent[key] = value
+    else:
+        parent.__dict__[key] = value
+
+def rename_key(data, path, new_key):
+    parts = split_path(path)
+    if not parts:
+        raise ValueError("the root of the save has no key to rename")
+
+    parent = get_path(data, '/'.join(path.split('/')[:-1]))
+    if isinstance(parent, dict):
+        mapping = parent
+    elif not isinstance(parent, (list, tuple)) and hasattr(parent, '__dict__'):
+        mapping = parent.__dict__
+    else:
+        raise ValueError(f"only dict keys and attributes can be renamed: {path}")
+
+    key = _child_key(parent, parts[-1], path)
+    if isinstance(key, tuple):
+        # A tuple key is renamed by giving all of its parts as a JSON array.
+        try:
+            new_key = json.loads(new_key)
+        except json.JSONDecodeError:
+            new_key = None
+        if not isinstance(new_key, list) or len(new_key) != len(key):
+            raise ValueError(f"{path} has a tuple key, give the new key as a JSON array of {len(key)} items")
+        new_key = _to_tuple(new_key)
+        try:
+            hash(new_key)
+        except TypeError:
+            raise ValueError(f"a tuple key can't hold a JSON object: {path}")
+    elif not isinstance(key, str):
+        # Other non-string keys take a JSON value of the same type, so
+        # renaming the key 5 to 6 doesn't quietly make it the string '6'.
+        # A None key can become anything, and plain text is taken as a string.
+        try:
+            new_key = json.loads(new_key)
+        except json.JSONDecodeError:
+            if key is not None:
+                raise ValueError(f"{path} has {a_type(key)} key, give the new key as a JSON value")
+        if type(key) is float and type(new_key) is int:
+            new_key = float(new_key)
+        if key is not None and type(new_key) is not type(key):
+            raise ValueError(f"{path} has {a_type(key)} key, the new key must be one too")
+        if isinstance(new_key, (list, dict)):
+            raise ValueError(f"a key can't be a JSON {'array' if isinstance(new_key, list) else 'object'}: {path}")
+    if new_key in mapping and new_key != key:
+        raise ValueError(f"cannot rename {path} to '{new_key}', that key already exists")
+
+    # Rebuild in place so the renamed key keeps its position.
+    items = [(new_key if k == key else k, v) for k, v in mapping.items()]
+    mapping.clear()
+    mapping.update(items)
+
+def join_path(parent, key, node=None):
+    # node is the container key belongs to; list and tuple indexes are
+    # written as plain numbers, other non-string keys as a KeyPart.
+    if isinstance(key, str) or isinstance(node, (list, tuple)):
+        part = str(key).replace('~', '~0').replace('/', '~1')
+        if part.startswith('#'):
+            part = '~2' + part[1:]
+    else:
+        part = format_key(key).replace('~', '~0').replace('/', '~1')
+    return part if not parent else f"{parent}/{part}"
+
+def a_type(value):
+    # The type of value for a message, e.g. 'an int', 'a str' or just 'None'.
+    if value is None:
+        return 'None'
+    name = type(value).__name__
+    return f"{'an' if name[0] in 'aeiouAEIOU' else 'a'} {name}"
+
+def type_name(value):
+    cls = type(value)
+    if cls.__module__ == 'builtins':
+        return cls.__name__
+    return f"{cls.__module__}.{cls.__name__}"
+
+def _children(value):
+    if isinstance(value, dict):
+        return list(value.items())
+    if isinstance(value, (list, tuple)):
+        return list(enumerate(value))
+    # Classes (e.g. a defaultdict factory) are referenced by name, not state.
+    if isinstance(value, (set, frozenset, str, bytes, type)):
+        return None
+    if hasattr(value, '__dict__'):
+        return list(value.__dict__.items())
+    return None
+
+def walk(data):
+    # Yields (path, value, first_path) in document order. first_path is set
+    # when a container is reached a second time (a shared or cyclic
+    # reference); those aren't descended into again.
+    seen = {}
+    stack = [('', data)]
+    while stack:
+        path, value = stack.pop()
+        children = _children(value)
+        if children is not None:
+            if id(value) in seen:
+                yield path, value, seen[id(value)]
+                continue
+            seen[id(value)] = path
+        yield path, value, None
+        if children:
+            stack.extend(reversed([(join_path(path, key, value), child) for key, child in children]))
+
+def describe_schema(data):
+    # Flat {path: type} map, with repeated containers reported as 'ref:<first path>'.
+    schema = {}
+    for path, value, first_path in walk(data):
+        # NumPy arrays are named by dtype and shape rather than their
+        # pickled reconstruct callable.
+        summary = numpy_summary(value) if first_path is None else None
+        if first_path is not None:
+            schema[path] = f"ref:{first_path}"
+        elif summary is not None:
+            schema[path] = f"numpy.ndarray[{summary['dtype']}, shape {tuple(summary['shape'])}]"
+        else:
+            schema[path] = type_name(value)
+    return schema
+
+def _hidden_paths(data):
+    # The paths of placeholder bookkeeping (constructor arguments and the
+    # like), which holds what the game passed in rather than editable text.
+    # Byte strings in a tuple BUILD state are hidden too: load_build marks
+    # them the same way, and they are raw data such as a NumPy array's.
+    hidden = set()
+    for path, value, first_path in walk(data):
+        if isinstance(value, GenericPlaceholder):
+            hidden.update(join_path(path, key, value) for key in GenericPlaceholder.EXTRA_KEYS
+                          if key in value.__dict__)
+            state = value.__dict__.get('state')
+            if isinstance(state, tuple):
+                state_path = join_path(path, 'state', value)
+                hidden.update(join_path(state_path, index, state) for index, item in enumerate(state)
+                              if type(item) is Latin1Str)
+    return hidden
+
+def _is_under(path, paths):
+    while path:
+        if path in paths:
+            return True
+        path = path.rpartition('/')[0]
+    return False
+
+def replace_strings(data, old, new, ignore_case=False, whole_value=False):
+    # Returns ([(path, count)], [(path, reason)]) for the values that were
+    # changed and those that matched but couldn't be written.
+    pattern = re.escape(old)
+    if whole_value:
+        pattern = f"^{pattern}$"
+    regex = re.compile(pattern, re.IGNORECASE if ignore_case else 0)
+    hidden = _hidden_paths(data)
+
+    # Collect matches first so we don't edit containers while walking them.
+    matches = []
+    for path, value, first_path in walk(data):
+        if isinstance(value, str) and not _is_under(path, hidden):
+            replaced, count = regex.subn(lambda m: new, value)
+            if count:
+                if type(value) is not str:
+                    # Keep a byte string a byte string, if the new text still fits in one.
+                    try:
+                        replaced.encode('latin-1')
+                    except UnicodeEncodeError:
+                        pass
+                    else:
+                        replaced = type(value)(replaced)
+                matches.append((path, replaced, count))
+
+    changed, skipped = [], []
+    for path, replaced, count in matches:
+        try:
+            set_path(data, path, replaced)
+        except ValueError as e:
+            skipped.append((path, str(e)))
+        else:
+            changed.append((path, count))
+    return changed, skipped
+
+NUMPY_RECONSTRUCT = {
+    ('numpy.core.multiarray', '_reconstruct'),
+    ('numpy._core.multiarray', '_reconstruct'),
+}
+
+def _numpy_dtype_name(dtype):
+    # numpy.dtype pickles as REDUCE(dtype, ('f8', False, True)) with its
+    # byte order second in the BUILD state.
+    args = getattr(dtype, '__dict__', {}).get(GenericPlaceholder.REDUCE_ARGS)
+    if not args:
+        return '?'
+    name = str(args[0])
+    state = dtype.__dict__.get('state')
+    if isinstance(state, tuple) and len(state) > 1 and state[1] in ('<', '>'):
+        name = state[1] + name
+    return name
+
+def numpy_summary(value):
+    # {'dtype', 'shape'} for a pickled NumPy array, read from its BUILD state
+    # (version, shape, dtype, is_fortran, data), or None for anything else.
+    # The array itself stays a placeholder and is pickled back untouched.
+    cls = type(value)
+    if not isinstance(value, GenericPlaceholder) or (cls.__module__, cls.__name__) not in NUMPY_RECONSTRUCT:
+        return None
+    state = value.__dict__.get('state')
+    if not isinstance(state, tuple) or len(state) != 5 or not isinstance(state[1], tuple):
+        return None
+    return {'dtype': _numpy_dtype_name(state[2]), 'shape': list(state[1])}
+
+def collect_stats(save):
+    nodes = 0
+    max_depth = 0
+    shared = 0
+    by_type = collections.Counter()
+    arrays = {}
+    for path, value, first_path in walk(save.data):
+        nodes += 1
+        max_depth = max(max_depth, len(split_path(path)))
+        if first_path is not None:
+            shared += 1
+        else:
+            by_type[type_name(value)] += 1
+            summary = numpy_summary(value)
+            if summary is not None:
+                arrays[path] = summary
+
+    return {
+        'log_size': save.log_size,
+        'nodes': nodes,
+        'max_depth': max_depth,
+        'shared_references': shared,
+        'types': dict(by_type.most_common()),
+        'numpy_arrays': arrays,
+    }
+
+def validate(save):
+    problems = []
+    for path, value, first_path in walk(save.data):
+        if first_path is None and isinstance(value, dict):
+            # jsonpickle leaves a tagged dict behind when it can't restore a value.
+            tags = [key for key in value if isinstance(key, str) and key.startswith('py/')]
+            if tags:
+                problems.append(f"{path or '<root>'}: '{tags[0]}' was left as a plain dict instead of being restored")
+
+    try:
+        log_content = dump_log(save)
+    except Exception as e:
+        problems.append(f"the data could not be pickled: {e}")
+        return problems
+
+    try:
+        load_pickle(log_content)
+    except ValueError as e:
+        problems.append(f"the rebuilt log does not load again: {e}")
+    return problems
+
+def _signature(data):
+    signature = {}
+    for path, value, first_path in walk(data):
+        leaf = None if _children(value) is not None else value
+        if path in signature:
+            # Two keys spelled the same, e.g. two objects with the same repr,
+            # would hide each other's changes.
+            raise ValueError(f"two values share the path {path}, they can't be compared")
+        signature[path] = (type_name(value), leaf, first_path)
+    return signature
+
+def _same(a, b):
+    # NaN never equals itself, but it's still the same value written back.
+    return a == b or (a != a and b != b)
+
+def diff_data(before, after):
+    # (path, 'added' | 'removed' | 'changed') for every path whose type, value
+    # or sharing differs. Inside an added or removed subtree only its top
+    # path is listed.
+    before, after = _signature(before), _signature(after)
+    kinds = {}
+    for path in sorted(before.keys() | after.keys()):
+        if path not in after:
+            kinds[path] = 'removed'
+        elif path not in before:
+            kinds[path] = 'added'
+        elif not all(_same(a, b) for a, b in zip(before[path], after[path])):
+            kinds[path] = 'changed'
+    return [(path, kind) for path, kind in kinds.items()
+            if kind == 'changed' or kinds.get(path.rpartition('/')[0]) != kind]
+
+def type_changes(before, after):
+    # (path, old type, new type) for the paths in both whose type differs,
+    # e.g. a number that an edit turned into a string.
+    before, after = _signature(before), _signature(after)
+    return [(path, before[path][0], after[path][0]) for path in sorted(before.keys() & after.keys())
+            if before[path][0] != after[path][0]]
+
+def compare_data(expected, actual):
+    # Paths where the two trees differ in type, value or sharing.
+    messages = {
+        'removed': "missing from the rebuilt save",
+        'added': "only in the rebuilt save",
+        'changed': "does not match the rebuilt save",
+    }
+    return [f"{path or '<root>'}: {messages[kind]}" for path, kind in diff_data(expected, actual)]
+
+def verify_save(save, output_file):
+    # Load the written file back the way decode would and check it holds
+    # the same data that was meant to be written.
+    try:
+        rebuilt = load_save(output_file, save.entry_name, save.container)
+    except ValueError as e:
+        return [f"the rebuilt save does not load: {e}"]
+    return compare_data(save.data, rebuilt.data)
+
+def encode_value(value):
+    # keys=True keeps int, tuple and None dict keys from collapsing into strings.
+    return json.loads(jsonpickle.encode(value, unpicklable=True, keys=True))
+
+def to_json(save, root=None):
+    # root limits the export to the subtree at that path; encode puts it
+    # back into the full save with merge_root.
+    json_friendly_data = encode_value(get_path(save.data, root) if root else save.data)
+
+    output_data = {
+        'metadata': save.metadata,
+        'data': json_friendly_data
+    }
+    if save.pickle_version is not None:
+        output_data['__pickle_version__'] = save.pickle_version
+    if save.entry_name != 'log':
+        output_data['__entry__'] = save.entry_name
+    if save.container != 'zip':
+        output_data['__container__'] = save.container
+    if root:
+        output_data['__root__'] = root
+    return output_data
+
+def _fingerprint(value):
+    # A hashable summary of a whole subtree, equal for subtrees that are the same.
+    entries = []
+    for path, item, first_path in walk(value):
+        leaf = None if _children(item) is not None else item
+        if isinstance(leaf, (set, frozenset)):
+            # Equal sets can iterate, and so print, in a different order.
+            leaf = frozenset(leaf)
+        try:
+            hash(leaf)
+        except TypeError:
+            leaf = repr(leaf)
+        entries.append((path, type_name(item), leaf, first_path))
+    return tuple(entries)
+
+def _merge_into(old, new, merged):
+    # Refill old with new's contents when both are the same kind of
+    # container, recursively (dicts and object state by key, tuples by
+    # position, lists as below), and return whichever object should take
+    # new's place. Keeping the old objects keeps every reference to them from
+    # elsewhere in the save, which the subtree export couldn't carry.
+    if id(new) in merged:
+        return merged[id(new)]
+    if type(old) is not type(new):
+        return new
+    if _children(old) is None:
+        # Unchanged values keep the old object too, e.g. a shared set.
+        return old if _same(old, new) else new
+    if isinstance(old, tuple):
+        if len(old) != len(new):
+            return new
+        items = [_merge_into(a, b, merged) for a, b in zip(old, new)]
+        return old if all(a is b for a, b in zip(items, old)) else type(old)(items)
+    merged[id(new)] = old
+    if isinstance(new, list):
+        # Items shift when one is added or removed, so old items are never
+        # refilled by position, which would pour one item into another that
+        # is referenced elsewhere. An old item is only kept in place of an
+        # exported one that is unchanged from it.
+        unused = collections.defaultdict(list)
+        for item in old:
+            unused[_fingerprint(item)].append(item)
+        items = []
+        for value in new:
+            if id(value) in merged:
+                items.append(merged[id(value)])
+                continue
+            candidates = unused.get(_fingerprint(value))
+            if candidates:
+                item = candidates.pop(0)
+                # The same walk order, so each exported container maps to
+                # its old counterpart for any other reference to it.
+                for (_, new_child, _), (_, old_child, _) in zip(walk(value), walk(item)):
+                    if _children(new_child) is not None:
+                        merged.setdefault(id(new_child), old_child)
+            else:
+                # Kept as exported, but objects inside it that are also
+                # reached elsewhere still get their merged counterparts.
+                item = _merge_into(value, value, merged)
+            items.append(item)
+        old[:] = items
+    elif isinstance(new, dict):
+        items = _merge_items(old, new, merged)
+        old.clear()
+        old.update(items)
+    if hasattr(new, '__dict__'):
+        items = _merge_items(old.__dict__, new.__dict__, merged)
+        old.__dict__.clear()
+        old.__dict__.update(items)
+    return old
+
+def _merge_items(old, new, merged):
+    # Keys that were already there keep the old key object, since the
+    # pickle shares those between objects just like values.
+    keys = {key: key for key in old}
+    return [(keys.get(key, key), _merge_into(old[key], value, merged) if key in old else value)
+            for key, value in new.items()]
+
+def merge_root(save, template_file, root):
+    # Put a subtree exported with decode --root back into the full save.
+    full = load_save(template_file, save.entry_name, save.container)
+    target = get_path(full.data, root)
+    merged = _merge_into(target, save.data, {})
+    if merged is not target:
+        set_path(full.data, root, merged)
+    save.data = full.data
+
+def register_placeholders(node):
+    # jsonpickle resolves py/object and py/type tags by importing the module,
+    # which fails for Ren'Py's classes, so create their placeholders first.
+    stack = [node]
+    while stack:
+        value = stack.pop()
+        if isinstance(value, dict):
+            for tag in ('py/object', 'py/type'):
+                name = value.get(tag)
+                if isinstance(name, str) and '.' in name:
+                    module, _, class_name = name.rpartition('.')
+                    try:
+                        __import__(module)
+                        getattr(sys.modules[module], class_name)
+                    except (ImportError, AttributeError, KeyError):
+                        get_placeholder_class(module, class_name)
+            stack.extend(value.values())
+        elif isinstance(value, list):
+            stack.extend(value)
+
+def from_json(input_data):
+    metadata = input_data.get('metadata', {})
+    data_as_dict = input_data.get('data', {})
+    data_as_json_str = json.dumps(data_as_dict)
+
+    register_placeholders(data_as_dict)
+
+    # Placeholders aren't importable, so hand jsonpickle the classes directly.
+    custom_unpickler = CustomJsonUnpickler(keys=True)
+    data = jsonpickle.decode(data_as_json_str, context=custom_unpickler,
+                             classes=list(_placeholder_cache.values()))
+
+    pickle_version = input_data.get('__pickle_version__', 2)
+    entry_name = input_data.get('__entry__', 'log')
+    container = input_data.get('__container__', 'zip')
+    return Save(data, metadata, pickle_version, entry_name, container)
@@ -0,0 +1,41 @@
+# Run from the repository root with: python -m unittest
+import os
+import pickle
+import subprocess
+import sys
+import jsonpickle
+import savefile
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+SAMPLE_SAVE = os.path.join(ROOT, '1-1-LT1.save')
+
+def jsonpickle_works():
+    # The JSON side needs the real jsonpickle; a stand-in module can still be
+    # imported, so check that it actually round-trips.
+    try:
+        return jsonpickle.decode(jsonpickle.encode([1, 2])) == [1, 2]
+    except Exception:
+        return False
+
+def roundtrip(data, protocol=2):
+    # Pickle data the way write_save does and load it back the way load_save does.
+    return savefile.load_pickle(savefile.dump_log(savefile.Save(data, pickle_version=protocol)))
+
+def json_roundtrip(save):
+    # decode's envelope, through real JSON text, and back through encode's path.
+    import json
+    return savefile.from_json(json.loads(json.dumps(savefile.to_json(save))))
+
+def dumps(data):
+    return pickle.dumps(data, protocol=2)
+
+def run_cli(*args):
+    return subprocess.run([sys.executable, os.path.join(ROOT, 'cli.py')] + list(args),
+                          capture_output=True, text=True, cwd=ROOT)
+
+def save_with_log(path, log_content):
+    # The sample save with its log swapped for a hand-built pickle.
+    import zipfile
+    with zipfile.ZipFile(SAMPLE_SAVE) as original, zipfile.ZipFile(path, 'w', zipfile.ZIP_DEFLATED) as z:
+        for item in original.infolist():
+            z.writestr(item, log_content if item.filename == 'log' else original.read(item.filename))
@@ -0,0 +1,172 @@
+import os
+import shutil
+import subprocess
+import sys
+import tempfile
+import unittest
+import cli
+import savefile
+from tests.support import ROOT, SAMPLE_SAVE, jsonpickle_works, run_cli, save_with_log
+
+def run_python(code, **env):
+    # A fresh interpreter with the given environment, for locale-dependent behaviour.
+    return subprocess.run([sys.executable, '-c', code], capture_output=True, cwd=ROOT,
+                          env=dict(os.environ, **env))
+
+class CliTests(unittest.TestCase):
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(self.tmp.cleanup)
+
+    def path(self, name):
+        return os.path.join(self.tmp.name, name)
+
+    def test_edit_set_and_get(self):
+        out = self.path('out.save')
+        result = run_cli('edit', SAMPLE_SAVE, '--set', '0/store.money=9999', '--out', out, '--verify')
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertEqual(savefile.get_path(savefile.load_save(out).data, '0/store.money'), 9999)
+
+    def test_edit_output_over_input(self):
+        save_file = self.path('same.save')
+        shutil.copy(SAMPLE_SAVE, save_file)
+        result = run_cli('edit', save_file, '--set', '0/store.money=5', '--out', save_file, '--verify')
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertEqual(savefile.get_path(savefile.load_save(save_file).data, '0/store.money'), 5)
+
+    def test_replace_summary_counts_one_of_each(self):
+        result = run_cli('replace', SAMPLE_SAVE, 'pause_menu', 'main_menu')
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertEqual(result.stdout.splitlines()[-1], '1 replacement in 1 field.')
+
+    def test_replace_without_matches_says_nothing_was_written(self):
+        out = self.path('out.save')
+        result = run_cli('replace', SAMPLE_SAVE, 'no such text', 'x', '--out', out)
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertIn(f"{out} was not written", result.stderr)
+        self.assertFalse(os.path.exists(out))
+
+    def test_edit_keeps_list_and_dict_subclasses(self):
+        out = self.path('out.save')
+        result = run_cli('edit', SAMPLE_SAVE, '--set', '0/store.nvl_list=[]',
+                         '--set', '0/store._predict_screen={"a": 1}', '--out', out, '--verify')
+        self.assertEqual(result.returncode, 0, result.stderr)
+        data = savefile.load_save(out).data
+        self.assertEqual(savefile.type_name(savefile.get_path(data, '0/store.nvl_list')), 'renpy.python.RevertableList')
+        predict = savefile.get_path(data, '0/store._predict_screen')
+        self.assertEqual(savefile.type_name(predict), 'renpy.python.RevertableDict')
+        self.assertEqual(predict, {'a': 1})
+
+    def test_yaml_output_is_utf8_on_any_console(self):
+        result = run_python("import cli; cli.write_text(cli.dump_envelope({'name': '美咲'}, 'yaml'))",
+                            PYTHONIOENCODING='cp1252')
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertEqual(result.stdout.decode('utf-8'), 'name: 美咲\n')
+
+    def test_yaml_without_pyyaml_is_a_plain_error(self):
+        # None in sys.modules makes the import fail as if it weren't installed.
+        code = ("import sys; sys.modules['yaml'] = None; import cli\n"
+                "try:\n    cli.dump_envelope({}, 'yaml')\n"
+                "except ValueError as e:\n    print(e)")
+        result = run_python(code)
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertIn(b'pip install pyyaml', result.stdout)
+
+    def test_yaml_input_is_read_as_utf8_in_any_locale(self):
+        with open(self.path('save.yaml'), 'w', encoding='utf-8') as f:
+            f.write('name: 美咲\n')
+        # The command line itself has to stay ASCII in the C locale.
+        code = f"import cli; assert cli.load_envelope({self.path('save.yaml')!r}, None) == {{'name': {ascii('美咲')}}}"
+        result = run_python(code, LC_ALL='C', PYTHONUTF8='0', PYTHONCOERCECLOCALE='0')
+        self.assertEqual(result.returncode, 0, result.stderr)
+
+    @unittest.skipUnless(jsonpickle_works(), "needs jsonpickle")
+    def test_decode_then_encode_in_separate_processes(self):
+        # encode runs in a fresh process, where Ren'Py's classes only exist
+        # once register_placeholders has created them.
+        decoded = run_cli('decode', SAMPLE_SAVE)
+        self.assertEqual(decoded.returncode, 0, decoded.stderr)
+        with open(self.path('save.json'), 'w', encoding='utf-8') as f:
+            f.write(decoded.stdout)
+        encoded = run_cli('encode', self.path('save.json'), SAMPLE_SAVE, self.path('out.save'), '--verify')
+        self.assertEqual(encoded.returncode, 0, encoded.stderr)
+        original = savefile.load_save(SAMPLE_SAVE)
+        rebuilt = savefile.load_save(self.path('out.save'))
+        self.assertEqual(savefile.diff_data(original.data, rebuilt.data), [])
+
+    @unittest.skipUnless(jsonpickle_works(), "needs jsonpickle")
+    def test_dry_run_flags_a_type_change(self):
+        import json
+        decoded = run_cli('decode', SAMPLE_SAVE)
+        self.assertEqual(decoded.returncode, 0, decoded.stderr)
+        envelope = json.loads(decoded.stdout)
+        with open(self.path('same.json'), 'w', encoding='utf-8') as f:
+            json.dump(envelope, f)
+        result = run_cli('encode', self.path('same.json'), SAMPLE_SAVE, '--dry-run')
+        self.assertEqual(result.returncode, 0, result.stderr)
+
+        save = savefile.from_json(envelope)
+        savefile.set_path(save.data, '1/__version__', '5')
+        with open(self.path('edited.json'), 'w', encoding='utf-8') as f:
+            json.dump(savefile.to_json(save), f)
+        result = run_cli('encode', self.path('edited.json'), SAMPLE_SAVE, '--dry-run')
+        self.assertEqual(result.returncode, 1)
+        self.assertIn('1/__version__: changed type from int in the template to str', result.stderr)
+
+    def test_save_holding_a_counter(self):
+        # {'c': collections.Counter({'a': 1})}. Loading it used to replace
+        # collections.Counter, which the tool itself uses.
+        log = b'\x80\x02}q\x00U\x01cccollections\nCounter\nq\x01}q\x02U\x01aK\x01s\x85q\x03Rq\x04s.'
+        save_file = self.path('counter.save')
+        save_with_log(save_file, log)
+        result = run_cli('stats', save_file)
+        self.assertEqual(result.returncode, 0, result.stderr)
+        result = run_cli('edit', save_file, '--set', 'n=1', '--out', self.path('out.save'), '--verify', '--audit')
+        self.assertEqual(result.returncode, 0, result.stderr)
+
+    def test_filling_in_a_null_is_only_a_warning(self):
+        template = {'name': None, 'money': 5, 'ratio': 1, 'level': 3}
+        edited = {'name': 'Alice', 'money': '5', 'ratio': 1.5, 'level': 3}
+        problems, warnings = cli.check_types(template, edited)
+        self.assertEqual(problems, ['money: changed type from int in the template to str'])
+        self.assertEqual(warnings, ['name: changed type from NoneType in the template to str',
+                                    'ratio: changed type from int in the template to float'])
+
+    def test_inspect_lists_the_opcodes(self):
+        result = run_cli('inspect', SAMPLE_SAVE)
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertIn('PROTO      2', result.stdout)
+        self.assertIn('STOP', result.stdout)
+
+    def test_inspect_a_compressed_persistent_file(self):
+        import pickle, zlib
+        with open(self.path('persistent'), 'wb') as f:
+            f.write(zlib.compress(pickle.dumps({'seen': True}, protocol=2)))
+        result = self.run_script('inspect_save.py', self.path('persistent'))
+        self.assertEqual(result.returncode, 0, result.stderr)
+        self.assertIn("BINUNICODE 'seen'", result.stdout)
+
+    def test_inspect_a_truncated_log(self):
+        import pickle
+        with open(self.path('broken.save'), 'wb') as f:
+            f.write(pickle.dumps({'seen': True}, protocol=2)[:-3])
+        result = run_cli('inspect', self.path('broken.save'), '--raw')
+        self.assertEqual(result.returncode, 1)
+        self.assertIn("BINUNICODE 'seen'", result.stdout)
+        self.assertIn('Error:', result.stderr)
+
+    def run_script(self, name, *args):
+        return subprocess.run([sys.executable, os.path.join(ROOT, name)] + list(args),
+                              capture_output=True, text=True, cwd=ROOT)
+
+    def test_decode_save_script_reports_errors_like_decode(self):
+        result = self.run_script('decode_save.py', self.path('missing.save'))
+        self.assertEqual(result.returncode, 1)
+        self.assertIn('no such file', result.stderr)
+
+    @unittest.skipUnless(jsonpickle_works(), "needs jsonpickle")
+    def test_decode_save_script_matches_decode(self):
+        self.assertEqual(self.run_script('decode_save.py', SAMPLE_SAVE).stdout, run_cli('decode', SAMPLE_SAVE).stdout)
+
+if __name__ == '__main__':
+    unittest.main()
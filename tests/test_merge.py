@@ -0,0 +1,80 @@
+import copy
+import json
+import os
+import tempfile
+import unittest
+import savefile
+from tests.support import SAMPLE_SAVE, jsonpickle_works, run_cli
+
+def export_root(save, root):
+    # What decode --root hands encode: fresh objects for the subtree only.
+    subtree = copy.deepcopy(savefile.get_path(save.data, root))
+    return savefile.Save(subtree, entry_name=save.entry_name, container=save.container)
+
+class MergeRootTests(unittest.TestCase):
+    def setUp(self):
+        self.original = savefile.load_save(SAMPLE_SAVE)
+
+    def test_unedited_subtree_gives_back_the_same_pickle(self):
+        for root in ['0', '1', '1/log']:
+            save = export_root(self.original, root)
+            savefile.merge_root(save, SAMPLE_SAVE, root)
+            self.assertEqual(savefile.dump_log(save), savefile.dump_log(self.original), root)
+
+    def test_edit_keeps_the_siblings(self):
+        save = export_root(self.original, '1')
+        savefile.set_path(save.data, '__version__', 6)
+        savefile.merge_root(save, SAMPLE_SAVE, '1')
+        self.assertEqual(savefile.diff_data(self.original.data, save.data), [('1/__version__', 'changed')])
+
+    def test_references_from_outside_the_subtree_are_kept(self):
+        shared = [1, 2]
+        with tempfile.TemporaryDirectory() as tmp:
+            template = os.path.join(tmp, 'template.save')
+            savefile.write_save(savefile.Save({'a': {'items': shared}, 'b': shared}), SAMPLE_SAVE, template)
+            save = export_root(savefile.load_save(template), 'a')
+            save.data['items'].append(3)
+            savefile.merge_root(save, template, 'a')
+        self.assertIs(save.data['a']['items'], save.data['b'])
+        self.assertEqual(save.data['b'], [1, 2, 3])
+
+    def test_removing_an_item_leaves_other_references_alone(self):
+        a, b = {'name': 'a', 'hp': 1}, {'name': 'b', 'hp': 2}
+        with tempfile.TemporaryDirectory() as tmp:
+            template = os.path.join(tmp, 'template.save')
+            savefile.write_save(savefile.Save({'party': [a, b], 'rival': a}), SAMPLE_SAVE, template)
+            save = export_root(savefile.load_save(template), 'party')
+            del save.data[0]
+            savefile.merge_root(save, template, 'party')
+        self.assertEqual(save.data['rival'], {'name': 'a', 'hp': 1})
+        self.assertEqual(save.data['party'], [{'name': 'b', 'hp': 2}])
+
+    def test_edited_list_item_is_a_new_object(self):
+        a = {'name': 'a', 'hp': 1}
+        with tempfile.TemporaryDirectory() as tmp:
+            template = os.path.join(tmp, 'template.save')
+            savefile.write_save(savefile.Save({'party': [a], 'rival': a}), SAMPLE_SAVE, template)
+            save = export_root(savefile.load_save(template), 'party')
+            save.data[0]['hp'] = 5
+            savefile.merge_root(save, template, 'party')
+        self.assertEqual(save.data['party'], [{'name': 'a', 'hp': 5}])
+        self.assertEqual(save.data['rival'], {'name': 'a', 'hp': 1})
+
+    @unittest.skipUnless(jsonpickle_works(), "needs jsonpickle")
+    def test_decode_root_then_encode(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            decoded = run_cli('decode', SAMPLE_SAVE, '--root', '1')
+            self.assertEqual(decoded.returncode, 0, decoded.stderr)
+            envelope = json.loads(decoded.stdout)
+            self.assertEqual(envelope['__root__'], '1')
+            with open(os.path.join(tmp, 'root.json'), 'w', encoding='utf-8') as f:
+                json.dump(envelope, f)
+            out = os.path.join(tmp, 'out.save')
+            encoded = run_cli('encode', os.path.join(tmp, 'root.json'), SAMPLE_SAVE, out, '--verify')
+            self.assertEqual(encoded.returncode, 0, encoded.stderr)
+            rebuilt = savefile.load_save(out)
+        self.assertEqual(savefile.diff_data(self.original.data, rebuilt.data), [])
+        self.assertEqual(len(savefile.dump_log(rebuilt)), len(savefile.dump_log(self.original)))
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,103 @@
+import unittest
+import savefile
+from tests.support import SAMPLE_SAVE
+
+class SetPathTests(unittest.TestCase):
+    def test_assigning_into_a_shared_tuple_updates_every_reference(self):
+        shared = ('master', 'black')
+        data = {'a': shared, 'b': [shared], 'c': {'d': shared}}
+        savefile.set_path(data, 'b/0/1', 'white')
+        self.assertEqual(data['a'], ('master', 'white'))
+        self.assertIs(data['a'], data['b'][0])
+        self.assertIs(data['a'], data['c']['d'])
+
+    def test_shared_tuple_in_the_sample_save(self):
+        save = savefile.load_save(SAMPLE_SAVE)
+        paths = [p for p, v, first_path in savefile.walk(save.data)
+                 if first_path == "1/log/0/context/music/#int:7/last_changed"]
+        target = savefile.get_path(save.data, paths[0])
+        savefile.set_path(save.data, paths[0] + '/1', 2)
+        rebuilt = savefile.get_path(save.data, paths[0])
+        self.assertEqual(rebuilt, (target[0], 2))
+        self.assertIs(savefile.get_path(save.data, '1/log/0/context/music/#int:7/last_changed'), rebuilt)
+        self.assertIsNot(rebuilt, target)
+        for path, value, first_path in savefile.walk(save.data):
+            self.assertIsNot(value, target, path)
+
+class PathSpellingTests(unittest.TestCase):
+    def test_keys_that_look_alike_get_their_own_paths(self):
+        data = {None: 1, 'None': 2, 5: 3, '5': 4, ('a', 1): 5, '#int:5': 6, 'a/b~c': 7}
+        schema = savefile.describe_schema(data)
+        self.assertEqual(len(schema), len(data) + 1)
+        self.assertEqual(sorted(savefile.get_path(data, path) for path in schema if path), sorted(data.values()))
+        self.assertEqual(savefile.get_path(data, '#none'), 1)
+        self.assertEqual(savefile.get_path(data, 'None'), 2)
+        self.assertEqual(savefile.get_path(data, '#int:5'), 3)
+        self.assertEqual(savefile.get_path(data, '5'), 4)
+        self.assertEqual(savefile.get_path(data, '#tuple:["a", 1]'), 5)
+        self.assertEqual(savefile.get_path(data, '~2int:5'), 6)
+        self.assertEqual(savefile.get_path(data, 'a~1b~0c'), 7)
+
+    def test_bare_number_still_finds_an_int_key(self):
+        self.assertEqual(savefile.get_path({5: 'x'}, '5'), 'x')
+
+    def test_set_path_can_add_a_non_string_key(self):
+        data = {}
+        savefile.set_path(data, '#int:5', 'x')
+        savefile.set_path(data, '#tuple:["a", ["b", 2]]', 'y')
+        self.assertEqual(data, {5: 'x', ('a', ('b', 2)): 'y'})
+
+    def test_rename_picks_the_none_key(self):
+        data = {None: 'a', 'None': 'b'}
+        savefile.rename_key(data, '#none', 'other')
+        self.assertEqual(data, {'other': 'a', 'None': 'b'})
+
+    def test_rename_keeps_an_int_key_an_int(self):
+        data = {5: 'a', 'x': 'b'}
+        savefile.rename_key(data, '#int:5', '6')
+        self.assertEqual(data, {6: 'a', 'x': 'b'})
+
+    def test_rename_a_nested_tuple_key(self):
+        data = {((1, 2), 3): 'a'}
+        savefile.rename_key(data, '#tuple:[[1, 2], 3]', '[[1, 2], 4]')
+        self.assertEqual(data, {((1, 2), 4): 'a'})
+
+    def test_tuple_keys_cant_hold_objects(self):
+        with self.assertRaises(ValueError):
+            savefile.rename_key({((1, 2), 3): 'a'}, '#tuple:[[1, 2], 3]', '[{"a": 1}, 4]')
+        with self.assertRaises(ValueError):
+            savefile.set_path({}, '#tuple:[{"a": 1}]', 'x')
+
+    def test_rename_refuses_to_change_the_key_type(self):
+        with self.assertRaisesRegex(ValueError, 'has an int key'):
+            savefile.rename_key({5: 'a'}, '#int:5', 'six')
+        with self.assertRaisesRegex(ValueError, 'has an int key'):
+            savefile.rename_key({5: 'a'}, '#int:5', '"6"')
+        with self.assertRaisesRegex(ValueError, 'has a float key'):
+            savefile.rename_key({0.5: 'a'}, '#float:0.5', 'half')
+
+    def test_rename_a_string_key_to_a_number_keeps_a_string(self):
+        data = {'5': 'a'}
+        savefile.rename_key(data, '5', '6')
+        self.assertEqual(data, {'6': 'a'})
+
+    def test_diff_sees_a_change_behind_a_look_alike_key(self):
+        before = {5: 'x', '5': 'y'}
+        after = {5: 'CHANGED', '5': 'y'}
+        self.assertEqual(savefile.diff_data(before, after), [('#int:5', 'changed')])
+
+    def test_type_changes_lists_existing_paths_only(self):
+        before = {'money': 42, 'name': 'Alice', 'flags': [1]}
+        after = {'money': '42', 'name': 'Alice', 'flags': (1,), 'new': 1}
+        self.assertEqual(savefile.type_changes(before, after),
+                         [('flags', 'list', 'tuple'), ('money', 'int', 'str')])
+
+    def test_diff_refuses_paths_it_cant_tell_apart(self):
+        class Key:
+            def __repr__(self):
+                return 'Key()'
+        with self.assertRaises(ValueError):
+            savefile.diff_data({Key(): 1, Key(): 2}, {})
+
+if __name__ == '__main__':
+    unittest.main()
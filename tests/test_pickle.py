@@ -0,0 +1,135 @@
+import datetime
+import os
+import subprocess
+import sys
+import tempfile
+import unittest
+import zipfile
+import savefile
+from tests.support import SAMPLE_SAVE, jsonpickle_works, roundtrip, run_cli, save_with_log
+
+# datetime.time(12, 34, 56) as Python 2 pickles it: REDUCE with a byte
+# string payload that happens to be ASCII.
+PY2_TIME = b'\x80\x02cdatetime\ntime\nq\x00U\x06\x0c\x228\x00\x00\x00q\x01\x85q\x02Rq\x03.'
+# {'name': 'caf\xe9' as a byte string, 'uni': u'caf\xe9'}
+PY2_LATIN1 = b'\x80\x02}q\x00(U\x04nameq\x01U\x04caf\xe9q\x02U\x03uniq\x03X\x05\x00\x00\x00caf\xc3\xa9q\x04u.'
+
+# numpy.array([1, 2, 3]) as Python 2 pickles it: REDUCE of _reconstruct,
+# then BUILD with (version, shape, dtype, is_fortran, raw data).
+PY2_ARRAY_DATA = b'\x01\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00'
+PY2_ARRAY = (b'\x80\x02cnumpy.core.multiarray\n_reconstruct\nq\x00cnumpy\nndarray\nq\x01K\x00\x85q\x02U\x01b\x87q\x03Rq\x04'
+             b'(K\x01K\x03\x85q\x05cnumpy\ndtype\nq\x06U\x02i8K\x00K\x01\x87q\x07Rq\x08'
+             b'(K\x03U\x01<NNNJ\xff\xff\xff\xffJ\xff\xff\xff\xffK\x00tq\tb\x89U\x18' + PY2_ARRAY_DATA + b'tq\nb.')
+
+def load_in_fresh_python(content):
+    # Placeholders stand in for datetime.time in this process, so check
+    # what real Python makes of the output elsewhere.
+    code = 'import pickle, sys; print(repr(pickle.loads(sys.stdin.buffer.read())))'
+    result = subprocess.run([sys.executable, '-c', code], input=content, capture_output=True, check=True)
+    return result.stdout.decode().strip()
+
+class ByteStringTests(unittest.TestCase):
+    def test_non_ascii_byte_string_keeps_its_bytes(self):
+        data = savefile.load_pickle(PY2_LATIN1)
+        self.assertIs(type(data['name']), savefile.Latin1Str)
+        self.assertIs(type(data['uni']), str)
+        rebuilt = roundtrip(data)
+        self.assertIs(type(rebuilt['name']), savefile.Latin1Str)
+        self.assertEqual(rebuilt['name'].encode('latin-1'), b'caf\xe9')
+        self.assertEqual(rebuilt['uni'], 'caf\xe9')
+
+    def test_ascii_constructor_argument_stays_a_byte_string(self):
+        time = savefile.load_pickle(PY2_TIME)
+        (payload,) = time.__dict__[savefile.GenericPlaceholder.REDUCE_ARGS]
+        self.assertIs(type(payload), savefile.Latin1Str)
+
+        output = savefile.dump_log(savefile.Save(time))
+        self.assertEqual(load_in_fresh_python(output), 'datetime.time(12, 34, 56)')
+        (payload,) = savefile.load_pickle(output).__dict__[savefile.GenericPlaceholder.REDUCE_ARGS]
+        self.assertIs(type(payload), savefile.Latin1Str)
+
+    def test_other_constructor_arguments_are_left_alone(self):
+        # store.Thing('a', None, 1)
+        thing = savefile.load_pickle(b'\x80\x02cstore\nThing\nq\x00(U\x01aNK\x01tq\x01Rq\x02.')
+        args = thing.__dict__[savefile.GenericPlaceholder.REDUCE_ARGS]
+        self.assertEqual([type(arg) for arg in args], [savefile.Latin1Str, type(None), int])
+
+    def test_other_ascii_byte_strings_load_as_text(self):
+        data = savefile.load_pickle(b'\x80\x02]q\x00(U\x03abcq\x01h\x01e.')
+        self.assertEqual([type(item) for item in data], [str, str])
+
+    @unittest.skipUnless(jsonpickle_works(), "needs jsonpickle")
+    def test_byte_strings_survive_json(self):
+        import json
+        data = {'name': savefile.load_pickle(PY2_LATIN1)['name'], 'time': savefile.load_pickle(PY2_TIME)}
+        encoded = json.loads(json.dumps(savefile.encode_value(data)))
+        self.assertEqual(encoded['name'], {'py/object': 'savefile.Latin1Str', 'latin1': 'caf\xe9'})
+        rebuilt = savefile.from_json({'data': encoded}).data
+        self.assertEqual(savefile.diff_data(data, rebuilt), [])
+
+class NumpyArrayTests(unittest.TestCase):
+    def setUp(self):
+        self.data = {'array': savefile.load_pickle(PY2_ARRAY)}
+
+    def test_summary(self):
+        self.assertEqual(savefile.numpy_summary(self.data['array']), {'dtype': '<i8', 'shape': [3]})
+        self.assertEqual(savefile.describe_schema(self.data)['array'], 'numpy.ndarray[<i8, shape (3,)]')
+        stats = savefile.collect_stats(savefile.Save(self.data))
+        self.assertEqual(stats['numpy_arrays'], {'array': {'dtype': '<i8', 'shape': [3]}})
+
+    def test_other_objects_have_no_summary(self):
+        self.assertIsNone(savefile.numpy_summary(savefile.load_pickle(PY2_TIME)))
+
+    def test_roundtrip_keeps_the_raw_data_as_bytes(self):
+        rebuilt = roundtrip(self.data)
+        self.assertEqual(savefile.diff_data(self.data, rebuilt), [])
+        state = rebuilt['array'].__dict__['state']
+        self.assertIs(type(state[4]), savefile.Latin1Str)
+        self.assertEqual(state[4].encode('latin-1'), PY2_ARRAY_DATA)
+        self.assertIs(type(state[2].__dict__['state'][1]), savefile.Latin1Str)
+
+class PlaceholderTests(unittest.TestCase):
+    def test_real_modules_are_left_alone(self):
+        time_class = datetime.time
+        replace = os.replace
+        savefile.load_pickle(PY2_TIME)
+        savefile.load_pickle(b'\x80\x02cos\nreplace\nq\x00.')
+        self.assertIs(datetime.time, time_class)
+        self.assertIs(os.replace, replace)
+
+    def test_save_that_names_a_stdlib_function_can_still_be_written(self):
+        # {'f': os.replace, 'n': 1}
+        log = b'\x80\x02}q\x00(U\x01fcos\nreplace\nq\x01U\x01nK\x01u.'
+        with tempfile.TemporaryDirectory() as tmp:
+            save_file = os.path.join(tmp, 'in.save')
+            out = os.path.join(tmp, 'out.save')
+            save_with_log(save_file, log)
+            result = run_cli('edit', save_file, '--set', 'n=2', '--out', out, '--verify')
+            self.assertEqual(result.returncode, 0, result.stderr)
+            self.assertEqual(sorted(os.listdir(tmp)), ['in.save', 'out.save'])
+            with zipfile.ZipFile(out) as z:
+                self.assertIn(b'cos\nreplace\n', z.read('log'))
+            self.assertEqual(savefile.load_save(out).data['n'], 2)
+
+class TruncationTests(unittest.TestCase):
+    def setUp(self):
+        with zipfile.ZipFile(SAMPLE_SAVE) as z:
+            self.log = z.read('log')
+
+    def test_truncated_anywhere_is_reported_as_truncated(self):
+        step = len(self.log) // 100
+        for size in list(range(1, 64)) + list(range(64, len(self.log), step)):
+            with self.subTest(size=size):
+                with self.assertRaises(ValueError) as caught:
+                    savefile.load_pickle(self.log[:size])
+                self.assertIn(f"save appears truncated at byte {size}", str(caught.exception))
+
+    def test_unknown_opcode_is_reported_as_corrupt(self):
+        content = b'\x80\x02]q\x00\xff.'
+        with self.assertRaises(ValueError) as caught:
+            savefile.load_pickle(content)
+        self.assertIn("save is corrupt near byte 3", str(caught.exception))
+        self.assertIn("unknown", str(caught.exception))
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,50 @@
+import unittest
+import savefile
+from tests.support import roundtrip
+from tests.test_pickle import PY2_ARRAY, PY2_ARRAY_DATA
+
+class ReplaceStringsTests(unittest.TestCase):
+    def test_constructor_arguments_are_left_alone(self):
+        PyExpr = savefile.get_placeholder_class('renpy.ast', 'PyExpr')
+        expr = PyExpr.__new__(PyExpr, 'name = "Alice"', 'game/script.rpy', 12)
+        expr.__dict__['label'] = 'Alice'
+        data = roundtrip({'expr': expr, 'name': 'Alice'})
+
+        changed, skipped = savefile.replace_strings(data, 'Alice', 'Bob')
+        self.assertEqual(sorted(changed), [('expr/label', 1), ('name', 1)])
+        self.assertEqual(skipped, [])
+        self.assertEqual(data['expr'].__dict__[savefile.GenericPlaceholder.NEWOBJ_ARGS][0], 'name = "Alice"')
+
+    def test_raw_state_bytes_are_left_alone(self):
+        # The array's data holds the byte \x01, and the dtype's state its
+        # byte order '<'.
+        data = {'array': savefile.load_pickle(PY2_ARRAY), 'name': 'Alice\x01'}
+        changed, skipped = savefile.replace_strings(data, '\x01', 'x')
+        self.assertEqual(changed, [('name', 1)])
+        self.assertEqual(skipped, [])
+        self.assertEqual(data['array'].__dict__['state'][4].encode('latin-1'), PY2_ARRAY_DATA)
+
+        changed, skipped = savefile.replace_strings(data, '<', '>')
+        self.assertEqual((changed, skipped), ([], []))
+
+    def test_byte_strings_stay_byte_strings(self):
+        data = {'a': savefile.Latin1Str('caf\xe9 Alice'), 'b': savefile.Latin1Str('Alice')}
+        savefile.replace_strings(data, 'Alice', 'Bob')
+        self.assertIs(type(data['a']), savefile.Latin1Str)
+        self.assertEqual(data['a'], 'caf\xe9 Bob')
+
+    def test_text_that_needs_unicode_becomes_unicode(self):
+        data = {'a': savefile.Latin1Str('Alice')}
+        savefile.replace_strings(data, 'Alice', '美咲')
+        self.assertIs(type(data['a']), str)
+        self.assertEqual(data['a'], '美咲')
+
+    def test_unwritable_matches_say_why(self):
+        changed, skipped = savefile.replace_strings(('Alice',), 'Alice', 'Bob')
+        self.assertEqual(changed, [])
+        self.assertEqual(len(skipped), 1)
+        self.assertEqual(skipped[0][0], '0')
+        self.assertIn('root', skipped[0][1])
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,78 @@
+import unittest
+import savefile
+from tests.support import SAMPLE_SAVE, jsonpickle_works, roundtrip, json_roundtrip
+
+class SampleSaveRoundTrip(unittest.TestCase):
+    # A no-op edit must give back the same structure. The bytes can't be
+    # compared, since a reloaded set may iterate in a different order.
+    def setUp(self):
+        self.save = savefile.load_save(SAMPLE_SAVE)
+
+    def test_pickle_roundtrip_keeps_structure(self):
+        self.assertEqual(savefile.diff_data(self.save.data, roundtrip(self.save.data)), [])
+
+    def test_pickle_output_size_stays_close(self):
+        # Python 2 str values come back as unicode, which costs a few bytes each.
+        size = len(savefile.dump_log(self.save))
+        self.assertLess(abs(size - self.save.log_size) / self.save.log_size, 0.02)
+
+    def test_write_and_reload(self):
+        import os, tempfile
+        with tempfile.TemporaryDirectory() as tmp:
+            out = os.path.join(tmp, 'out.save')
+            savefile.write_save(self.save, SAMPLE_SAVE, out)
+            self.assertEqual(savefile.verify_save(self.save, out), [])
+
+    @unittest.skipUnless(jsonpickle_works(), "needs jsonpickle")
+    def test_json_roundtrip_keeps_structure(self):
+        rebuilt = json_roundtrip(self.save)
+        self.assertEqual(savefile.diff_data(self.save.data, rebuilt.data), [])
+        self.assertEqual(savefile.validate(rebuilt), [])
+
+class HandBuiltPickles(unittest.TestCase):
+    def test_containers_and_scalars(self):
+        data = {
+            'tuple': (1, 'a', (2.5, None)),
+            'set': {1, 2},
+            'frozenset': frozenset(['x']),
+            'big': 2 ** 80,
+            'complex': 1 + 2j,
+            'keys': {5: 'int', None: 'none', (1, 2): 'tuple'},
+        }
+        rebuilt = roundtrip(data)
+        self.assertEqual(rebuilt, data)
+        self.assertEqual(savefile.diff_data(data, rebuilt), [])
+
+    def test_none_key_and_none_string_key_stay_apart(self):
+        data = {None: 'key', 'None': 'string'}
+        rebuilt = roundtrip(data)
+        self.assertEqual(rebuilt, data)
+        self.assertEqual(sorted(savefile.describe_schema(rebuilt)), ['', '#none', 'None'])
+
+    @unittest.skipUnless(jsonpickle_works(), "needs jsonpickle")
+    def test_none_key_and_none_string_key_survive_json(self):
+        save = savefile.Save({None: 'key', 'None': 'string'}, pickle_version=2)
+        self.assertEqual(json_roundtrip(save).data, {None: 'key', 'None': 'string'})
+
+    def test_python3_bytes_come_back_as_the_same_bytes(self):
+        # Protocol 2 writes bytes as _codecs.encode(text, 'latin1'), the same
+        # form used for Python 2 byte strings, so both load as Latin1Str.
+        rebuilt = roundtrip(b'\x00\xff')
+        self.assertIs(type(rebuilt), savefile.Latin1Str)
+        self.assertEqual(rebuilt.encode('latin-1'), b'\x00\xff')
+
+    def test_shared_references_stay_shared(self):
+        shared = [1, 2]
+        rebuilt = roundtrip({'a': shared, 'b': shared})
+        self.assertIs(rebuilt['a'], rebuilt['b'])
+
+    def test_unknown_class_with_state_and_items(self):
+        # store.Bag is a dict subclass Ren'Py would pickle as NEWOBJ, SETITEMS and BUILD.
+        content = (b'\x80\x02cstore\nBag\nq\x00)\x81q\x01(U\x01aK\x01u}q\x02U\x04noteU\x01xsb.')
+        bag = savefile.load_pickle(content)
+        self.assertEqual(bag.__dict__[savefile.GenericPlaceholder.DICT_ITEMS], {'a': 1})
+        self.assertEqual(bag.note, 'x')
+        self.assertEqual(savefile.diff_data(bag, roundtrip(bag)), [])
+
+if __name__ == '__main__':
+    unittest.main()
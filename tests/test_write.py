@@ -0,0 +1,57 @@
+import os
+import shutil
+import tempfile
+import unittest
+from unittest import mock
+import savefile
+from tests.support import SAMPLE_SAVE
+
+class WriteSaveTests(unittest.TestCase):
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(self.tmp.cleanup)
+        self.save_file = os.path.join(self.tmp.name, 'same.save')
+        shutil.copy(SAMPLE_SAVE, self.save_file)
+
+    def test_output_can_be_the_template(self):
+        with open(self.save_file, 'rb') as f:
+            before = f.read()
+        save = savefile.load_save(self.save_file)
+        savefile.set_path(save.data, '0/store.money', 1234)
+        backup_file = savefile.write_save(save, self.save_file, self.save_file)
+
+        rebuilt = savefile.load_save(self.save_file)
+        self.assertEqual(savefile.get_path(rebuilt.data, '0/store.money'), 1234)
+        self.assertEqual(savefile.diff_data(save.data, rebuilt.data), [])
+        self.assertEqual(backup_file, self.save_file + '.bak')
+        with open(backup_file, 'rb') as f:
+            self.assertEqual(f.read(), before)
+        self.assertEqual(sorted(os.listdir(self.tmp.name)), ['same.save', 'same.save.bak'])
+
+    def test_separate_output_makes_no_backup(self):
+        out_file = os.path.join(self.tmp.name, 'out.save')
+        save = savefile.load_save(self.save_file)
+        self.assertIsNone(savefile.write_save(save, self.save_file, out_file))
+        self.assertEqual(sorted(os.listdir(self.tmp.name)), ['out.save', 'same.save'])
+
+    def test_failed_write_leaves_the_template_alone(self):
+        with open(self.save_file, 'rb') as f:
+            before = f.read()
+        save = savefile.load_save(self.save_file)
+        with mock.patch('os.replace', side_effect=OSError("disk full")):
+            with self.assertRaises(OSError):
+                savefile.write_save(save, self.save_file, self.save_file)
+        with open(self.save_file, 'rb') as f:
+            self.assertEqual(f.read(), before)
+        self.assertFalse([name for name in os.listdir(self.tmp.name) if name.endswith('.tmp')])
+
+    def test_raw_output_over_its_input(self):
+        raw_file = os.path.join(self.tmp.name, 'log.pickle')
+        with open(raw_file, 'wb') as f:
+            f.write(savefile.dump_log(savefile.load_save(SAMPLE_SAVE)))
+        save = savefile.load_save(raw_file, container='raw')
+        savefile.write_save(save, raw_file, raw_file)
+        self.assertEqual(savefile.verify_save(save, raw_file), [])
+
+if __name__ == '__main__':
+    unittest.main()